@@ -1,13 +1,17 @@
 package bencoderpc
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"github.com/3M3RY/go-bencode"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/rpc"
 	"testing"
+	"time"
 )
 
 type Args struct {
@@ -63,6 +67,36 @@ func init() {
 	rpc.Register(new(Arith))
 }
 
+type CtxArith int
+
+// Wait blocks until ctx is done, so tests can exercise Client.CallContext's
+// cancellation without a real long-running call.
+func (t *CtxArith) Wait(ctx context.Context, args *Args, reply *Reply) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// WaitThenSucceed blocks until ctx is done, then succeeds anyway, so
+// tests can exercise a response that lands after Client.CallContext has
+// already returned ctx.Err() to its caller.
+func (t *CtxArith) WaitThenSucceed(ctx context.Context, args *Args, reply *Reply) error {
+	<-ctx.Done()
+	reply.C = 999
+	return nil
+}
+
+// waitSignal receives once a WaitSignal call's Context is done, so
+// TestServerCancelsContextOnDisconnect can observe that happening without
+// a cancel message ever being sent for it.
+var waitSignal = make(chan struct{}, 1)
+
+// WaitSignal is like Wait, but also signals waitSignal once ctx is done.
+func (t *CtxArith) WaitSignal(ctx context.Context, args *Args, reply *Reply) error {
+	<-ctx.Done()
+	waitSignal <- struct{}{}
+	return ctx.Err()
+}
+
 /*
 // These tests are disabled because bencode. Decode will ignore
 // these calls and deadlock waiting for more input.
@@ -194,6 +228,238 @@ func TestClient(t *testing.T) {
 	}
 }
 
+func TestNotify(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go ServeConn(srv)
+
+	client := NewClient(cli)
+	defer client.Close()
+
+	if err := client.Notify("Arith.Add", &Args{1, 2}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	// The notification above must not produce a response; the next call's
+	// reply should be the only thing waiting on the wire.
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{3, 4}, reply); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if reply.C != 7 {
+		t.Fatalf("Add: got %d want %d", reply.C, 7)
+	}
+}
+
+func TestCallBatch(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go ServeBatchConn(srv)
+
+	client := NewBatchClient(cli)
+	defer client.Close()
+
+	addReply := new(Reply)
+	mulReply := new(Reply)
+	divReply := new(Reply)
+	calls := []BatchCall{
+		{ServiceMethod: "Arith.Add", Args: &Args{1, 2}, Reply: addReply},
+		{ServiceMethod: "Arith.Mul", Args: &Args{3, 4}, Reply: mulReply},
+		{ServiceMethod: "Arith.Div", Args: &Args{1, 0}, Reply: divReply},
+	}
+
+	if err := client.CallBatch(calls); err != nil {
+		t.Fatalf("CallBatch: %v", err)
+	}
+	if calls[0].Error != nil {
+		t.Errorf("Add: expected no error but got %q", calls[0].Error)
+	}
+	if addReply.C != 3 {
+		t.Errorf("Add: got %d want %d", addReply.C, 3)
+	}
+	if calls[1].Error != nil {
+		t.Errorf("Mul: expected no error but got %q", calls[1].Error)
+	}
+	if mulReply.C != 12 {
+		t.Errorf("Mul: got %d want %d", mulReply.C, 12)
+	}
+	if calls[2].Error == nil {
+		t.Errorf("Div: expected divide by zero error")
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+
+	server := NewServer()
+	if err := server.Register(new(CtxArith)); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	go server.ServeConn(srv)
+
+	client := NewClient(cli)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	reply := new(Reply)
+	err := client.CallContext(ctx, "CtxArith.Wait", &Args{}, reply)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("CallContext: got %v want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCallContextStaleResponse(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+
+	server := NewServer()
+	if err := server.Register(new(CtxArith)); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	go server.ServeConn(srv)
+
+	client := NewClient(cli)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	reply := &Reply{C: 42}
+	err := client.CallContext(ctx, "CtxArith.WaitThenSucceed", &Args{}, reply)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("CallContext: got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	// WaitThenSucceed's reply, sent after CallContext already returned,
+	// must not land in reply.
+	time.Sleep(50 * time.Millisecond)
+	if reply.C != 42 {
+		t.Errorf("CallContext: reply mutated by a stale response: got %d want %d", reply.C, 42)
+	}
+}
+
+func TestServerCancelsContextOnDisconnect(t *testing.T) {
+	cli, srv := net.Pipe()
+
+	server := NewServer()
+	if err := server.Register(new(CtxArith)); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	go server.ServeConn(srv)
+
+	client := NewClient(cli)
+
+	// Dispatch WaitSignal and disconnect without ever sending a cancel
+	// message for it, as a client that simply drops the connection
+	// mid-call would. WaitSignal's Context must still be cancelled, or
+	// the handler goroutine leaks forever and ServeCodec's wg.Wait never
+	// returns.
+	client.Go("CtxArith.WaitSignal", &Args{}, new(Reply), make(chan *rpc.Call, 1))
+	client.Close()
+
+	select {
+	case <-waitSignal:
+	case <-time.After(time.Second):
+		t.Fatal("WaitSignal's Context was never cancelled after the connection closed without a cancel message")
+	}
+}
+
+func TestFramed(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go rpc.ServeCodec(NewFramedServerCodec(srv))
+
+	client := rpc.NewClientWithCodec(NewFramedClientCodec(cli))
+	defer client.Close()
+
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{7, 8}, reply); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if reply.C != 15 {
+		t.Errorf("Add: got %d want %d", reply.C, 15)
+	}
+}
+
+func TestFramedMaxSize(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	framer := NewLengthFramerSize(srv, 4)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := framer.ReadFrame()
+		errCh <- err
+	}()
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], 1<<20)
+	if _, err := cli.Write(size[:]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := <-errCh; err == nil {
+		t.Fatalf("ReadFrame: expected an error for a frame over the configured maximum")
+	}
+}
+
+// TestFramedClientSkipsKeepalives exercises framedClientCodec.ReadResponseHeader
+// against a long run of zero-length keepalive frames, the client-side
+// counterpart of the stack-overflow bug commit 53561fe fixed on the
+// server read path: ReadResponseHeader must loop past them instead of
+// recursing, or enough of them would crash the process before this test
+// could even observe the eventual read error below.
+func TestFramedClientSkipsKeepalives(t *testing.T) {
+	cli, srv := net.Pipe()
+
+	go func() {
+		defer srv.Close()
+		var zero [4]byte
+		for i := 0; i < 10000; i++ {
+			if _, err := srv.Write(zero[:]); err != nil {
+				return
+			}
+		}
+	}()
+
+	codec := NewFramedClientCodec(cli)
+	defer codec.Close()
+
+	var r rpc.Response
+	if err := codec.ReadResponseHeader(&r); err == nil {
+		t.Fatalf("ReadResponseHeader: expected an error once srv closes after the keepalive frames, got nil")
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	HandleHTTP(DefaultRPCPath, DefaultDebugPath)
+	go http.Serve(l, nil)
+
+	client, err := DialHTTP("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialHTTP: %v", err)
+	}
+	defer client.Close()
+
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{7, 8}, reply); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if reply.C != 15 {
+		t.Errorf("Add: got %d want %d", reply.C, 15)
+	}
+}
+
 func TestMalformedInput(t *testing.T) {
 	cli, srv := net.Pipe()
 	go cli.Write([]byte("e0:")) // invalid bencode
@@ -0,0 +1,332 @@
+package bencoderpc
+
+import (
+	"errors"
+	"github.com/3M3RY/go-bencode"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// batchServerCodec extends serverCodec so a client may send a bencode list
+// of request dicts as a single value. Each element of the list is fed to
+// rpc.ServeCodec one at a time through the normal ReadRequestHeader path,
+// and the responses are accumulated until the whole batch has been
+// answered, at which point they are flushed back as a single bencode list.
+type batchServerCodec struct {
+	*serverCodec
+
+	mutex   sync.Mutex
+	queue   []bencode.RawMessage    // undelivered elements of the batch being read
+	group   *serverBatch            // accumulator for the batch currently being read, nil outside one
+	batches map[uint64]*serverBatch // seq -> group, for every seq that belongs to a batch
+}
+
+// serverBatch accumulates the encoded responses for one incoming batch
+// until every request in it has been answered.
+type serverBatch struct {
+	remaining int
+	responses []bencode.RawMessage
+}
+
+// NewBatchServerCodec returns a new rpc.ServerCodec using bencode rpc on
+// conn that additionally accepts a bencode list of requests as a single
+// batch, replying with a single bencode list of responses.
+func NewBatchServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &batchServerCodec{
+		serverCodec: newServerCodec(conn),
+		batches:     make(map[uint64]*serverBatch),
+	}
+}
+
+func (c *batchServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		c.mutex.Lock()
+		if len(c.queue) == 0 {
+			c.mutex.Unlock()
+
+			var raw bencode.RawMessage
+			if err := c.dec.Decode(&raw); err != nil {
+				return err
+			}
+
+			c.mutex.Lock()
+			if len(raw) > 0 && raw[0] == 'l' {
+				var elems []bencode.RawMessage
+				if err := bencode.Unmarshal(raw, &elems); err != nil {
+					c.mutex.Unlock()
+					return err
+				}
+				c.queue = elems
+				c.group = &serverBatch{remaining: len(elems)}
+			} else {
+				c.queue = []bencode.RawMessage{raw}
+				c.group = nil
+			}
+		}
+
+		elem := c.queue[0]
+		c.queue = c.queue[1:]
+		group := c.group
+		c.mutex.Unlock()
+
+		c.req.reset()
+		if err := bencode.Unmarshal(elem, &c.req); err != nil {
+			return err
+		}
+		if c.req.Cancel != nil {
+			c.cancelSeq(string(*c.req.Cancel))
+			// A cancel element produces no response of its own, but it still
+			// occupied a slot in the batch's count, so account for it the same
+			// way an answered request would be.
+			if group != nil {
+				if flush, responses := c.accountGroup(group, nil); flush && len(responses) > 0 {
+					if err := c.enc.Encode(responses); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		c.bindRequestHeader(r)
+
+		if group != nil {
+			c.mutex.Lock()
+			c.batches[r.Seq] = group
+			c.mutex.Unlock()
+		}
+		return nil
+	}
+}
+
+// accountGroup records the completion of one request belonging to group,
+// appending resp to its accumulated responses unless resp is nil (a
+// notification or an in-batch cancel produces none), and reports whether
+// the whole batch has now been answered.
+func (c *batchServerCodec) accountGroup(group *serverBatch, resp bencode.RawMessage) (flush bool, responses []bencode.RawMessage) {
+	c.mutex.Lock()
+	if resp != nil {
+		group.responses = append(group.responses, resp)
+	}
+	group.remaining--
+	flush = group.remaining == 0
+	responses = group.responses
+	c.mutex.Unlock()
+	return flush, responses
+}
+
+func (c *batchServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.mutex.Lock()
+	group, batched := c.batches[r.Seq]
+	if batched {
+		delete(c.batches, r.Seq)
+	}
+	c.mutex.Unlock()
+
+	if !batched {
+		return c.serverCodec.WriteResponse(r, x)
+	}
+
+	resp, skip, err := c.buildResponse(r, x)
+	if err != nil {
+		return err
+	}
+
+	var raw bencode.RawMessage
+	if !skip {
+		raw, err = bencode.Marshal(resp)
+		if err != nil {
+			return err
+		}
+	}
+
+	flush, responses := c.accountGroup(group, raw)
+	if !flush || len(responses) == 0 {
+		// A batch of only notifications and in-batch cancels produces no
+		// responses at all; sending an empty bencode list back would be an
+		// unsolicited reply to a batch the client never asked to hear from
+		// again, so stay silent instead.
+		return nil
+	}
+	return c.enc.Encode(responses)
+}
+
+// batchClientCodec extends clientCodec so Client.CallBatch can coalesce
+// several requests into a single bencode list and demultiplex the matching
+// bencode list response, while still routing each reply through the
+// existing pending map so ordinary Call/Go usage is unaffected.
+type batchClientCodec struct {
+	*clientCodec
+
+	mutex     sync.Mutex
+	buffering bool
+	reqs      []clientRequest  // requests buffered since startBatch, awaiting flush
+	queue     []clientResponse // undelivered elements of a batch response being read
+}
+
+// NewBatchClientCodec returns a new rpc.ClientCodec using bencode RPC on
+// conn that additionally lets Client.CallBatch coalesce many requests into
+// a single bencode list.
+func NewBatchClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return newBatchClientCodec(conn)
+}
+
+func newBatchClientCodec(conn io.ReadWriteCloser) *batchClientCodec {
+	return &batchClientCodec{clientCodec: newClientCodec(conn)}
+}
+
+// startBatch begins buffering outgoing requests instead of writing them.
+func (c *batchClientCodec) startBatch() {
+	c.mutex.Lock()
+	c.buffering = true
+	c.mutex.Unlock()
+}
+
+// flush writes every request buffered since startBatch as a single bencode
+// list and stops buffering.
+func (c *batchClientCodec) flush() error {
+	c.mutex.Lock()
+	reqs := c.reqs
+	c.reqs = nil
+	c.buffering = false
+	c.mutex.Unlock()
+
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	// The write itself, not just the decision to buffer, must run under
+	// the embedded clientCodec's mutex: that is the lock writeNotify,
+	// writeCancel and WriteRequest's own final Encode all hold for their
+	// entire Encode call, since bencode.Encoder is not safe for
+	// concurrent use and those paths can run concurrently with a
+	// CallBatch flush on the same Client.
+	c.clientCodec.mutex.Lock()
+	defer c.clientCodec.mutex.Unlock()
+	return c.enc.Encode(reqs)
+}
+
+func (c *batchClientCodec) WriteRequest(r *rpc.Request, params interface{}) error {
+	c.mutex.Lock()
+	c.pending[r.Seq] = r.ServiceMethod
+	req := clientRequest{Id: r.Seq, Method: r.ServiceMethod, Params: params}
+	buffering := c.buffering
+	if buffering {
+		c.reqs = append(c.reqs, req)
+	}
+	c.mutex.Unlock()
+
+	// seqHook, and the real write below, are guarded by the embedded
+	// clientCodec's own mutex, not batchClientCodec's c.mutex above, since
+	// that is the mutex Client.CallContext uses to arm the hook and the
+	// mutex every other write path (writeNotify, writeCancel, flush) holds
+	// for its entire Encode call, as bencode.Encoder is not safe for
+	// concurrent use, regardless of which codec the Client was built with.
+	c.clientCodec.mutex.Lock()
+	defer c.clientCodec.mutex.Unlock()
+	if c.seqHook != nil {
+		c.seqHook(r.Seq)
+		c.seqHook = nil
+	}
+
+	if buffering {
+		return nil
+	}
+	return c.enc.Encode(&req)
+}
+
+func (c *batchClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	c.mutex.Lock()
+	if len(c.queue) > 0 {
+		c.resp = c.queue[0]
+		c.queue = c.queue[1:]
+		c.mutex.Unlock()
+	} else {
+		c.mutex.Unlock()
+
+		var raw bencode.RawMessage
+		if err := c.dec.Decode(&raw); err != nil {
+			return err
+		}
+
+		if len(raw) > 0 && raw[0] == 'l' {
+			var resps []clientResponse
+			if err := bencode.Unmarshal(raw, &resps); err != nil {
+				return err
+			}
+			if len(resps) == 0 {
+				// batchServerCodec never sends one (see WriteResponse); an
+				// empty list is always a malformed or non-conforming peer,
+				// not a batch of all-notification/all-cancel requests.
+				return errors.New("bencoderpc: empty batch response")
+			}
+			c.mutex.Lock()
+			c.resp = resps[0]
+			c.queue = resps[1:]
+			c.mutex.Unlock()
+		} else {
+			c.resp.reset()
+			if err := bencode.Unmarshal(raw, &c.resp); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	r.ServiceMethod = c.pending[c.resp.Id]
+	delete(c.pending, c.resp.Id)
+	c.mutex.Unlock()
+
+	r.Seq = c.resp.Id
+	if c.resp.Error != "" {
+		r.Error = c.resp.Error
+	}
+	return nil
+}
+
+// BatchCall describes one request within a Client.CallBatch call. Reply
+// must be set before the call, the same as an rpc.Call; Error is filled in
+// once the batch completes.
+type BatchCall struct {
+	ServiceMethod string
+	Args          interface{}
+	Reply         interface{}
+	Error         error
+}
+
+// NewBatchClient returns a new Client whose CallBatch method is usable,
+// coalescing the requests it is given into a single bencode list.
+func NewBatchClient(conn io.ReadWriteCloser) *Client {
+	codec := newBatchClientCodec(conn)
+	return &Client{rpc.NewClientWithCodec(codec), codec.clientCodec, codec, sync.Mutex{}}
+}
+
+// CallBatch sends every call in calls together as a single bencode list
+// request, blocks until the matching list response arrives, and fills in
+// each call's Reply and Error. It requires a Client returned by
+// NewBatchClient.
+func (client *Client) CallBatch(calls []BatchCall) error {
+	if client.batch == nil {
+		return errors.New("bencoderpc: CallBatch requires a client created with NewBatchClient")
+	}
+	if len(calls) == 0 {
+		return nil
+	}
+
+	client.batch.startBatch()
+
+	pending := make([]*rpc.Call, len(calls))
+	for i, call := range calls {
+		pending[i] = client.Go(call.ServiceMethod, call.Args, call.Reply, make(chan *rpc.Call, 1))
+	}
+
+	if err := client.batch.flush(); err != nil {
+		return err
+	}
+
+	for i, c := range pending {
+		<-c.Done
+		calls[i].Error = c.Error
+	}
+	return nil
+}
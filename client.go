@@ -1,11 +1,14 @@
 package bencoderpc
 
 import (
+	"context"
 	"github.com/3M3RY/go-bencode"
 	"io"
 	"net"
 	"net/rpc"
+	"reflect"
 	"sync"
+	"time"
 )
 
 type clientCodec struct {
@@ -21,12 +24,21 @@ type clientCodec struct {
 	// Package rpc expects both.
 	// We save the request method in pending when sending a request
 	// and then look it up by request ID when filling out the rpc Response.
-	mutex   sync.Mutex        // protects pending
+	mutex   sync.Mutex        // protects pending, seqHook, and writes to enc
 	pending map[uint64]string // map request id to method name
+
+	// seqHook, when set, is called once with the seq of the very next
+	// WriteRequest and then cleared. Client.CallContext uses it to learn
+	// which seq a pending call was assigned, so it can later cancel it.
+	seqHook func(seq uint64)
 }
 
 // NewClientCodec returns a new rpc.ClientCodec using bencode RPC on conn.
 func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return newClientCodec(conn)
+}
+
+func newClientCodec(conn io.ReadWriteCloser) *clientCodec {
 	return &clientCodec{
 		dec:     bencode.NewDecoder(conn),
 		enc:     bencode.NewEncoder(conn),
@@ -44,11 +56,46 @@ type clientRequest struct {
 func (c *clientCodec) WriteRequest(r *rpc.Request, params interface{}) error {
 	c.mutex.Lock()
 	c.pending[r.Seq] = r.ServiceMethod
-	c.mutex.Unlock()
+	if c.seqHook != nil {
+		c.seqHook(r.Seq)
+		c.seqHook = nil
+	}
 	c.req.Id = r.Seq
 	c.req.Method = r.ServiceMethod
 	c.req.Params = params
-	return c.enc.Encode(&c.req)
+	err := c.enc.Encode(&c.req)
+	c.mutex.Unlock()
+	return err
+}
+
+// cancelRequest is a request with only a "c" key, asking the server to
+// cancel the in-flight request whose id is seq. The server never replies
+// to it, the same as a notification.
+type cancelRequest struct {
+	Cancel uint64 `bencode:"c"`
+}
+
+// writeCancel encodes and sends a cancel message for seq, bypassing the
+// pending map since no response will ever arrive for it.
+func (c *clientCodec) writeCancel(seq uint64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.enc.Encode(&cancelRequest{seq})
+}
+
+// notifyRequest is a request with no "i" key. A server that speaks
+// bencoderpc's notification convention will not send a response to it.
+type notifyRequest struct {
+	Method string      `bencode:"m"`
+	Params interface{} `bencode:"p"`
+}
+
+// writeNotify encodes and sends a notification, bypassing the pending map
+// since no response will ever arrive for it.
+func (c *clientCodec) writeNotify(serviceMethod string, params interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.enc.Encode(&notifyRequest{serviceMethod, params})
 }
 
 type clientResponse struct {
@@ -93,14 +140,131 @@ func (c *clientCodec) Close() error {
 	return c.c.Close()
 }
 
-// NewClient returns a new rpc.Client to handle requests to the
+// SetReadDeadline implements DeadlineSetter by forwarding to the
+// underlying connection, if it is a net.Conn; otherwise it is a no-op.
+func (c *clientCodec) SetReadDeadline(t time.Time) error {
+	if nc, ok := c.c.(net.Conn); ok {
+		return nc.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// SetWriteDeadline implements DeadlineSetter by forwarding to the
+// underlying connection, if it is a net.Conn; otherwise it is a no-op.
+func (c *clientCodec) SetWriteDeadline(t time.Time) error {
+	if nc, ok := c.c.(net.Conn); ok {
+		return nc.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// DeadlineSetter is implemented by client and server codecs that can pass
+// read/write deadlines through to their underlying connection.
+type DeadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// Client is an rpc.Client that also supports bencoderpc notifications,
+// requests for which the server neither sends nor the client waits for a
+// response.
+type Client struct {
+	*rpc.Client
+	codec *clientCodec
+	batch *batchClientCodec // non-nil only for a Client returned by NewBatchClient
+
+	// callMu makes dispatching a call — optionally arming codec.seqHook and
+	// handing off to the embedded *rpc.Client's Go — atomic with respect to
+	// every other call dispatched through this Client, so a seqHook armed
+	// for one call can never be consumed by another's WriteRequest. It is
+	// held only for that handoff, not for the call's full round trip, so
+	// outstanding calls still complete concurrently as usual.
+	callMu sync.Mutex
+}
+
+// NewClient returns a new Client to handle requests to the
 // set of services at the other end of the connection.
-func NewClient(conn io.ReadWriteCloser) *rpc.Client {
-	return rpc.NewClientWithCodec(NewClientCodec(conn))
+func NewClient(conn io.ReadWriteCloser) *Client {
+	codec := newClientCodec(conn)
+	return &Client{rpc.NewClientWithCodec(codec), codec, nil, sync.Mutex{}}
+}
+
+// send dispatches a call through the embedded *rpc.Client, arming hook (if
+// non-nil) to learn the seq it was assigned. See callMu.
+func (client *Client) send(serviceMethod string, args, reply interface{}, done chan *rpc.Call, hook func(seq uint64)) *rpc.Call {
+	client.callMu.Lock()
+	defer client.callMu.Unlock()
+	if hook != nil {
+		client.codec.mutex.Lock()
+		client.codec.seqHook = hook
+		client.codec.mutex.Unlock()
+	}
+	call := client.Client.Go(serviceMethod, args, reply, done)
+	if hook != nil {
+		// If the call failed before ever reaching WriteRequest (e.g. the
+		// client is shutting down), nothing will consume or clear the
+		// hook; do it ourselves so a later, unrelated call doesn't trigger
+		// it.
+		client.codec.mutex.Lock()
+		client.codec.seqHook = nil
+		client.codec.mutex.Unlock()
+	}
+	return call
+}
+
+// Go shadows the embedded *rpc.Client's Go so every call dispatched
+// through this Client, including CallContext's, is serialized by callMu;
+// see send.
+func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	return client.send(serviceMethod, args, reply, done, nil)
+}
+
+// Call shadows the embedded *rpc.Client's Call so it goes through this
+// Client's own Go, rather than the embedded one; see Go.
+func (client *Client) Call(serviceMethod string, args, reply interface{}) error {
+	call := <-client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1)).Done
+	return call.Error
+}
+
+// Notify sends serviceMethod a one-way request carrying params. Unlike Call
+// or Go, Notify does not register a pending call and returns as soon as the
+// request has been written; the server will not send a reply.
+func (client *Client) Notify(serviceMethod string, params interface{}) error {
+	return client.codec.writeNotify(serviceMethod, params)
+}
+
+// CallContext is like Call, but returns ctx.Err() as soon as ctx is done,
+// and sends the server a cancel message for the request so a context-aware
+// service method (see Server) can stop the work in progress. Nothing stops
+// a response from landing after ctx.Done fires, so CallContext hands the
+// embedded *rpc.Client a throwaway value of reply's type to decode into,
+// and only copies it into the caller's reply once the call has actually
+// finished; a late response decodes into the throwaway instead of racing
+// a read the caller makes of reply after CallContext has already returned.
+// As with Call, reply may be nil if the caller doesn't want the result.
+func (client *Client) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	var scratch interface{}
+	if reply != nil {
+		scratch = reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+	}
+
+	var seq uint64
+	call := client.send(serviceMethod, args, scratch, make(chan *rpc.Call, 1), func(s uint64) { seq = s })
+
+	select {
+	case <-call.Done:
+		if call.Error == nil && reply != nil {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(scratch).Elem())
+		}
+		return call.Error
+	case <-ctx.Done():
+		client.codec.writeCancel(seq)
+		return ctx.Err()
+	}
 }
 
 // Dial connects to a bencode RPC server at the specified network address.
-func Dial(network, address string) (*rpc.Client, error) {
+func Dial(network, address string) (*Client, error) {
 	conn, err := net.Dial(network, address)
 	if err != nil {
 		return nil, err
@@ -6,4 +6,31 @@
 // A response contains an error string, a call identifier, and a result object in
 // in a bencode dictionary keyed by 'e', 'i', and 'r' respectively.
 // Call identifiers are not required to be integers.
+//
+// A request with no 'i' key is a notification: the server does not send a
+// response and the caller, via Client.Notify, does not wait for one.
+//
+// A bencode list may be sent in place of a single request dict, carrying
+// several requests as one batch; Client.CallBatch sends one, and
+// ServeBatchConn replies with a matching list of responses.
+//
+// A request dict may also carry a 'c' key instead of 'm'/'p', asking the
+// server to cancel the request with the given id; Client.CallContext sends
+// one automatically when its context.Context is done. Methods registered
+// on a Server, rather than via rpc.Register, may opt into receiving the
+// resulting context.Context by taking it as their first argument.
+//
+// HandleHTTP and DialHTTP/DialHTTPPath let bencoderpc share an HTTP server
+// or connect through one, the same way net/rpc does: the client sends an
+// HTTP CONNECT to the registered path, and the server hijacks the
+// connection and switches to the bencode RPC protocol over it.
+//
+// NewFramedServerCodec and NewFramedClientCodec carry each request or
+// response in its own discrete frame, by default a 4-byte big-endian
+// length prefix, rather than decoding them back-to-back off a stream.
+// This lets bencoderpc run over packet-oriented transports, and lets the
+// framed server codec skip a single malformed request instead of
+// desynchronizing the whole connection; the framed client codec still
+// fails on a malformed response. Implement Framer to use a different
+// framing.
 package bencoderpc
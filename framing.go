@@ -0,0 +1,221 @@
+package bencoderpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/3M3RY/go-bencode"
+	"io"
+	"net/rpc"
+	"strconv"
+)
+
+// Framer bounds each bencode value exchanged over a connection into a
+// discrete message, so framedServerCodec and framedClientCodec can decode
+// exactly one value per frame. This lets bencoderpc ride on top of
+// packet-oriented transports (UDP with reassembly, WebSocket messages,
+// message queues) and recover from a single malformed message without
+// losing track of where the next one starts, which the plain
+// bencode.Decoder-on-a-stream codecs can't do. framedServerCodec drops a
+// request frame that fails to decode and goes on to the next one;
+// framedClientCodec returns the decode error of a malformed response
+// frame, which ends the rpc.Client's connection as with the plain codecs.
+//
+// NewLengthFramer is the default Framer, used by NewFramedServerCodec and
+// NewFramedClientCodec. Implement Framer yourself, and pass it to
+// NewFramedServerCodecFramer or NewFramedClientCodecFramer, to plug in a
+// different framing (e.g. newline- or utp-delimited).
+type Framer interface {
+	// ReadFrame returns the bencode-encoded bytes of exactly one value.
+	ReadFrame() ([]byte, error)
+
+	// WriteFrame writes b, the bencode encoding of exactly one value, as
+	// a single frame.
+	WriteFrame(b []byte) error
+}
+
+// DefaultMaxFrameSize is the maximum frame length NewLengthFramer will
+// allocate for, unless overridden with NewLengthFramerSize. It bounds how
+// much a single 4-byte length prefix can make ReadFrame allocate before
+// the frame's contents, which come from the same untrusted transport,
+// have been read or validated at all.
+const DefaultMaxFrameSize = 1 << 20 // 1 MiB
+
+// lengthFramer is the default Framer: each frame is a 4-byte big-endian
+// length prefix followed by that many bytes of bencode.
+type lengthFramer struct {
+	c   io.ReadWriter
+	max uint32
+}
+
+// NewLengthFramer returns the default Framer, which prefixes each frame
+// with its length as a 4-byte big-endian unsigned integer and rejects any
+// frame declaring a length over DefaultMaxFrameSize.
+func NewLengthFramer(conn io.ReadWriter) Framer {
+	return NewLengthFramerSize(conn, DefaultMaxFrameSize)
+}
+
+// NewLengthFramerSize is like NewLengthFramer, but rejects a frame as
+// soon as its length prefix declares more than max bytes, instead of
+// allocating a buffer for it.
+func NewLengthFramerSize(conn io.ReadWriter, max uint32) Framer {
+	return &lengthFramer{c: conn, max: max}
+}
+
+func (f *lengthFramer) ReadFrame() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(f.c, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > f.max {
+		return nil, errors.New("bencoderpc: frame length " + strconv.FormatUint(uint64(n), 10) + " exceeds maximum " + strconv.FormatUint(uint64(f.max), 10))
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(f.c, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (f *lengthFramer) WriteFrame(b []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(b)))
+	if _, err := f.c.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := f.c.Write(b)
+	return err
+}
+
+// framedServerCodec extends serverCodec to read and write each request
+// and response as a single value through a Framer instead of decoding
+// them back-to-back off the stream with serverCodec's bencode.Decoder.
+type framedServerCodec struct {
+	*serverCodec
+	framer Framer
+}
+
+// NewFramedServerCodec returns a new rpc.ServerCodec using bencode RPC on
+// conn, with each request and response carried in its own frame via
+// NewLengthFramer. Use NewFramedServerCodecFramer for a different Framer.
+func NewFramedServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return NewFramedServerCodecFramer(conn, NewLengthFramer(conn))
+}
+
+// NewFramedServerCodecFramer is like NewFramedServerCodec, but reads and
+// writes frames through framer instead of the default length prefix.
+func NewFramedServerCodecFramer(conn io.ReadWriteCloser, framer Framer) rpc.ServerCodec {
+	return &framedServerCodec{
+		serverCodec: newServerCodec(conn),
+		framer:      framer,
+	}
+}
+
+func (c *framedServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		frame, err := c.framer.ReadFrame()
+		if err != nil {
+			return err
+		}
+		if len(frame) == 0 {
+			// A zero-length frame carries no value; treat it as a keepalive
+			// and wait for the next one instead of failing to decode it.
+			continue
+		}
+		c.req.reset()
+		if err := bencode.Unmarshal(frame, &c.req); err != nil {
+			// The framer has already consumed the whole malformed frame, so
+			// drop it and read the next one instead of ending the connection.
+			continue
+		}
+		if c.req.Cancel != nil {
+			c.cancelSeq(string(*c.req.Cancel))
+			continue
+		}
+		c.bindRequestHeader(r)
+		return nil
+	}
+}
+
+func (c *framedServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	resp, skip, err := c.buildResponse(r, x)
+	if err != nil || skip {
+		return err
+	}
+	raw, err := bencode.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return c.framer.WriteFrame(raw)
+}
+
+// framedClientCodec extends clientCodec to read and write each request
+// and response as a single value through a Framer instead of encoding
+// them back-to-back onto the stream with clientCodec's bencode.Encoder.
+type framedClientCodec struct {
+	*clientCodec
+	framer Framer
+}
+
+// NewFramedClientCodec returns a new rpc.ClientCodec using bencode RPC on
+// conn, with each request and response carried in its own frame via
+// NewLengthFramer. Use NewFramedClientCodecFramer for a different Framer.
+func NewFramedClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return NewFramedClientCodecFramer(conn, NewLengthFramer(conn))
+}
+
+// NewFramedClientCodecFramer is like NewFramedClientCodec, but reads and
+// writes frames through framer instead of the default length prefix.
+func NewFramedClientCodecFramer(conn io.ReadWriteCloser, framer Framer) rpc.ClientCodec {
+	return &framedClientCodec{
+		clientCodec: newClientCodec(conn),
+		framer:      framer,
+	}
+}
+
+func (c *framedClientCodec) WriteRequest(r *rpc.Request, params interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pending[r.Seq] = r.ServiceMethod
+	if c.seqHook != nil {
+		c.seqHook(r.Seq)
+		c.seqHook = nil
+	}
+	c.req.Id = r.Seq
+	c.req.Method = r.ServiceMethod
+	c.req.Params = params
+	raw, err := bencode.Marshal(&c.req)
+	if err != nil {
+		return err
+	}
+	return c.framer.WriteFrame(raw)
+}
+
+func (c *framedClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	for {
+		frame, err := c.framer.ReadFrame()
+		if err != nil {
+			return err
+		}
+		if len(frame) == 0 {
+			// A zero-length frame carries no value; treat it as a keepalive
+			// and wait for the next one instead of failing to decode it.
+			continue
+		}
+		c.resp.reset()
+		if err := bencode.Unmarshal(frame, &c.resp); err != nil {
+			return err
+		}
+
+		c.mutex.Lock()
+		r.ServiceMethod = c.pending[c.resp.Id]
+		delete(c.pending, c.resp.Id)
+		c.mutex.Unlock()
+
+		r.Seq = c.resp.Id
+		if c.resp.Error != "" {
+			r.Error = c.resp.Error
+		}
+		return nil
+	}
+}
@@ -0,0 +1,137 @@
+package bencoderpc
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+)
+
+const (
+	// DefaultRPCPath is the HTTP path HandleHTTP registers bencode RPC
+	// CONNECT requests on, mirroring rpc.DefaultRPCPath.
+	DefaultRPCPath = "/_bencodeRPC_"
+
+	// DefaultDebugPath is the HTTP path HandleHTTP registers the debug
+	// handler on, mirroring rpc.DefaultDebugPath.
+	DefaultDebugPath = "/debug/bencoderpc"
+
+	// scratchGobPath and scratchDebugPath are the paths handed to
+	// rpc.DefaultServer.HandleHTTP on the scratch mux built by init below
+	// to pull out its debug-listing handler; see rpcDebugHandler. Neither
+	// is ever registered on a mux any caller actually serves, so their
+	// exact spelling doesn't matter.
+	scratchGobPath   = "/debug/bencoderpc-gob"
+	scratchDebugPath = "/debug/bencoderpc-scratch"
+)
+
+// rpcDebugHandler is rpc.DefaultServer's own debug-listing http.Handler,
+// extracted once at init time; see the init function below for how and
+// why. HandleHTTP reuses it as-is rather than building a second listing.
+var rpcDebugHandler http.Handler
+
+// init extracts rpc.DefaultServer's debug-listing handler without also
+// standing up a live gob RPC CONNECT endpoint, which is the only other
+// way to obtain one: that handler isn't exported, and the only way to get
+// at it is to call rpc.Server.HandleHTTP, which registers both a debug
+// handler and a gob CONNECT handler able to invoke every service on
+// rpc.DefaultServer — not something a bencode RPC package should stand up
+// as a side effect of printing a debug page.
+//
+// init gets the listing handler without that side effect by pointing
+// rpc.DefaultServer.HandleHTTP at a scratch mux, via a temporary swap of
+// the global http.DefaultServeMux, and pulling only the debug handler
+// back out of it; the scratch mux and its gob CONNECT handler are then
+// discarded unreferenced. The handler itself reads rpc.DefaultServer's
+// service map fresh on every request, so it stays accurate no matter how
+// many services are registered afterward or how many times HandleHTTP is
+// later called.
+//
+// Doing the swap here, rather than in HandleHTTP itself, is what makes it
+// safe: init runs to completion before main, and therefore before any
+// http.Serve could be routing live traffic through http.DefaultServeMux,
+// so there is no window in which a concurrent request can be misrouted
+// into the scratch mux. Swapping the global at HandleHTTP call time
+// instead would race exactly such traffic, since nothing requires
+// HandleHTTP to be called before the server is already live.
+func init() {
+	scratch := http.NewServeMux()
+	real := http.DefaultServeMux
+	http.DefaultServeMux = scratch
+	rpc.DefaultServer.HandleHTTP(scratchGobPath, scratchDebugPath)
+	http.DefaultServeMux = real
+
+	h, _ := scratch.Handler(&http.Request{Method: "GET", URL: &url.URL{Path: scratchDebugPath}})
+	rpcDebugHandler = h
+}
+
+// Can connect to bencode RPC using HTTP CONNECT to rpcPath.
+var connected = "200 Connected to Go bencode RPC"
+
+// ServeHTTP implements an http.Handler that answers bencode RPC requests,
+// the same CONNECT convention net/rpc uses.
+func ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("bencoderpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
+	ServeConn(conn)
+}
+
+// HandleHTTP registers an HTTP handler for bencode RPC messages on
+// rpcPath, and a debugging handler on debugPath. ServeConn dispatches
+// against rpc.DefaultServer, so the debug handler reuses
+// rpc.DefaultServer's own service listing (see rpcDebugHandler) rather
+// than keeping a second one. Unlike rpc.Server.HandleHTTP, it is safe to
+// call after http.Serve is already routing live traffic through
+// http.DefaultServeMux, since rpcDebugHandler was built once at init
+// time. It is still necessary to invoke http.Serve, typically in a go
+// statement.
+func HandleHTTP(rpcPath, debugPath string) {
+	http.Handle(rpcPath, http.HandlerFunc(ServeHTTP))
+	http.Handle(debugPath, rpcDebugHandler)
+}
+
+// DialHTTP connects to an HTTP bencode RPC server at the specified
+// network address listening on DefaultRPCPath.
+func DialHTTP(network, address string) (*Client, error) {
+	return DialHTTPPath(network, address, DefaultRPCPath)
+}
+
+// DialHTTPPath connects to an HTTP bencode RPC server at the specified
+// network address and path.
+func DialHTTPPath(network, address, path string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+
+	// Require successful HTTP response before switching to RPC protocol.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == connected {
+		return NewClient(conn), nil
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, &net.OpError{
+		Op:   "dial-http",
+		Net:  network + " " + address,
+		Addr: nil,
+		Err:  err,
+	}
+}
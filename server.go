@@ -1,11 +1,14 @@
 package bencoderpc
 
 import (
+	"context"
 	"errors"
 	"github.com/3M3RY/go-bencode"
 	"io"
+	"net"
 	"net/rpc"
 	"sync"
+	"time"
 )
 
 // Bug(emery): requests missing params are ignored by bencode.
@@ -25,18 +28,38 @@ type serverCodec struct {
 	// but save the original request ID in the pending map.
 	// When rpc responds, we use the sequence number in
 	// the response to find the original request ID.
-	mutex   sync.Mutex // protects seq, pending
-	seq     uint64
-	pending map[uint64]*bencode.RawMessage //TODO benchmark this without a pointer
+	mutex         sync.Mutex // protects seq, pending, notifications, idKey, ctxs, cancels, cancelled
+	seq           uint64
+	pending       map[uint64]*bencode.RawMessage //TODO benchmark this without a pointer
+	notifications map[uint64]bool                // sequences that came in without an "i" and expect no reply
+	idKey         map[string]uint64              // original request id, as encoded bencode, to our sequence number; lets a later "c" cancel message find it
+
+	// ctxs and cancels are populated lazily, by Context, only for a seq
+	// whose dispatched method actually asked for its context.Context; the
+	// plain ServeConn/rpc.DefaultServer path, where no method ever does,
+	// pays no per-request context.WithCancel cost.
+	ctxs      map[uint64]context.Context    // sequence number to the Context handed to its service method
+	cancels   map[uint64]context.CancelFunc // sequence number to the CancelFunc for ctxs[seq]
+	cancelled map[uint64]bool               // sequence numbers cancelled before Context was ever called for them
+	closed    bool                          // set by cancelPending; makes every future Context call return one already done
 }
 
 // NewServerCodec returns a new rpc.ServerCodec using bencode rpc on conn.
 func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return newServerCodec(conn)
+}
+
+func newServerCodec(conn io.ReadWriteCloser) *serverCodec {
 	return &serverCodec{
-		dec:     bencode.NewDecoder(conn),
-		enc:     bencode.NewEncoder(conn),
-		c:       conn,
-		pending: make(map[uint64]*bencode.RawMessage),
+		dec:           bencode.NewDecoder(conn),
+		enc:           bencode.NewEncoder(conn),
+		c:             conn,
+		pending:       make(map[uint64]*bencode.RawMessage),
+		notifications: make(map[uint64]bool),
+		idKey:         make(map[string]uint64),
+		ctxs:          make(map[uint64]context.Context),
+		cancels:       make(map[uint64]context.CancelFunc),
+		cancelled:     make(map[uint64]bool),
 	}
 }
 
@@ -44,12 +67,14 @@ type serverRequest struct {
 	Id     *bencode.RawMessage `bencode:"i"`
 	Method string              `bencode:"m"`
 	Params *bencode.RawMessage `bencode:"p"`
+	Cancel *bencode.RawMessage `bencode:"c"`
 }
 
 func (r *serverRequest) reset() {
 	r.Id = nil
 	r.Method = ""
 	r.Params = nil
+	r.Cancel = nil
 }
 
 type serverResponse struct {
@@ -59,24 +84,94 @@ type serverResponse struct {
 }
 
 func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
-	c.req.reset()
-	if err := c.dec.Decode(&c.req); err != nil {
-		return err
+	for {
+		c.req.reset()
+		if err := c.dec.Decode(&c.req); err != nil {
+			return err
+		}
+		if c.req.Cancel != nil {
+			c.cancelSeq(string(*c.req.Cancel))
+			continue
+		}
+		c.bindRequestHeader(r)
+		return nil
 	}
+}
 
+// bindRequestHeader assigns the already-decoded c.req an internal sequence
+// number, recording it in pending or notifications, and fills in r.
+func (c *serverCodec) bindRequestHeader(r *rpc.Request) {
 	r.ServiceMethod = c.req.Method
 
 	// keep a seperate internal id
 	c.mutex.Lock()
 	c.seq++
+	seq := c.seq
 	if c.req.Id != nil {
-		c.pending[c.seq] = c.req.Id
+		c.pending[seq] = c.req.Id
+		c.idKey[string(*c.req.Id)] = seq
+	} else {
+		// A request with no "i" is a notification: the caller does not
+		// want, and must not receive, a response.
+		c.notifications[seq] = true
 	}
 	c.req.Id = nil
-	r.Seq = c.seq
+	r.Seq = seq
 	c.mutex.Unlock()
+}
 
-	return nil
+// cancelSeq cancels the Context of the pending request whose original
+// request id encodes to key, if there is one. A cancel message for an
+// unknown or already-answered id is ignored. If no context-aware method
+// has called Context for that seq yet, the cancellation is remembered so
+// Context creates it already done, rather than requiring a cancel to lose
+// a race against dispatch.
+func (c *serverCodec) cancelSeq(key string) {
+	c.mutex.Lock()
+	seq, ok := c.idKey[key]
+	if !ok {
+		c.mutex.Unlock()
+		return
+	}
+	cancel, ok := c.cancels[seq]
+	if !ok {
+		c.cancelled[seq] = true
+		c.mutex.Unlock()
+		return
+	}
+	c.mutex.Unlock()
+	cancel()
+}
+
+// Context returns the context.Context associated with the pending request
+// sequence seq, for use by a Server dispatching an opt-in context-aware
+// service method. It creates the Context on first call for seq, so a
+// dispatch path that never calls Context never pays for one; it returns
+// context.Background() for an unknown seq. If the connection has already
+// closed by the time Context is called — the dispatching goroutine raced
+// cancelPending and lost — the Context it hands back is already done,
+// instead of registering a CancelFunc cancelPending has no further chance
+// to invoke.
+func (c *serverCodec) Context(seq uint64) context.Context {
+	c.mutex.Lock()
+	if ctx, ok := c.ctxs[seq]; ok {
+		c.mutex.Unlock()
+		return ctx
+	}
+	if _, ok := c.pending[seq]; !ok && !c.notifications[seq] {
+		c.mutex.Unlock()
+		return context.Background()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.ctxs[seq] = ctx
+	c.cancels[seq] = cancel
+	precancelled := c.cancelled[seq] || c.closed
+	delete(c.cancelled, seq)
+	c.mutex.Unlock()
+	if precancelled {
+		cancel()
+	}
+	return ctx
 }
 
 func (c *serverCodec) ReadRequestBody(x interface{}) error {
@@ -92,14 +187,38 @@ func (c *serverCodec) ReadRequestBody(x interface{}) error {
 var zero = bencode.RawMessage([]byte("i0e"))
 
 func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}) error {
-	var resp serverResponse
+	resp, skip, err := c.buildResponse(r, x)
+	if err != nil || skip {
+		return err
+	}
+	return c.enc.Encode(resp)
+}
+
+// buildResponse looks up the original request id for r.Seq and assembles
+// the serverResponse to send for it. skip is true for a notification,
+// which must produce no response at all.
+func (c *serverCodec) buildResponse(r *rpc.Response, x interface{}) (resp serverResponse, skip bool, err error) {
 	c.mutex.Lock()
+	if cancel, ok := c.cancels[r.Seq]; ok {
+		cancel()
+		delete(c.cancels, r.Seq)
+		delete(c.ctxs, r.Seq)
+	}
+	delete(c.cancelled, r.Seq)
+	if c.notifications[r.Seq] {
+		delete(c.notifications, r.Seq)
+		c.mutex.Unlock()
+		return resp, true, nil
+	}
 	b, ok := c.pending[r.Seq]
 	if !ok {
 		c.mutex.Unlock()
-		return errors.New("invalid sequence number in response")
+		return resp, false, errors.New("invalid sequence number in response")
 	}
 	delete(c.pending, r.Seq)
+	if b != nil {
+		delete(c.idKey, string(*b))
+	}
 	c.mutex.Unlock()
 
 	if b == nil {
@@ -111,16 +230,65 @@ func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}) error {
 	if r.Error != "" {
 		resp.Error = r.Error
 	}
-	return c.enc.Encode(resp)
+	return resp, false, nil
 }
 
 func (c *serverCodec) Close() error {
+	c.cancelPending()
 	return c.c.Close()
 }
 
+// cancelPending cancels the Context of every request still in flight,
+// i.e. every seq with an entry left in c.cancels because its response
+// was never sent, and marks the codec closed so that a dispatched method
+// which hasn't called Context yet — it lost the race against this very
+// call — gets back a Context that is already done instead of registering
+// a CancelFunc cancelPending will never get another chance to invoke. It
+// is called both from Close, for a direct caller, and by
+// Server.ServeCodec's shutdown path before it waits on the in-flight
+// handlers, so a context-aware handler blocked on <-ctx.Done() is
+// unblocked as soon as the connection goes away instead of leaking
+// forever waiting for a cancel message or response that will never
+// arrive; see Server's doc comment.
+func (c *serverCodec) cancelPending() {
+	c.mutex.Lock()
+	c.closed = true
+	cancels := c.cancels
+	c.cancels = make(map[uint64]context.CancelFunc)
+	c.mutex.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+// SetReadDeadline implements DeadlineSetter by forwarding to the
+// underlying connection, if it is a net.Conn; otherwise it is a no-op.
+func (c *serverCodec) SetReadDeadline(t time.Time) error {
+	if nc, ok := c.c.(net.Conn); ok {
+		return nc.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// SetWriteDeadline implements DeadlineSetter by forwarding to the
+// underlying connection, if it is a net.Conn; otherwise it is a no-op.
+func (c *serverCodec) SetWriteDeadline(t time.Time) error {
+	if nc, ok := c.c.(net.Conn); ok {
+		return nc.SetWriteDeadline(t)
+	}
+	return nil
+}
+
 // ServeConn runs the bencode rpc server on a single connection.
 // ServeConn blocks, serving the connection until the client hangs up.
 // The caller typically invokes ServeConn in a go statement.
 func ServeConn(conn io.ReadWriteCloser) {
 	rpc.ServeCodec(NewServerCodec(conn))
 }
+
+// ServeBatchConn is like ServeConn, but additionally accepts a bencode
+// list of requests as a single batch, replying with a single bencode list
+// of responses. It understands ordinary, unbatched requests too.
+func ServeBatchConn(conn io.ReadWriteCloser) {
+	rpc.ServeCodec(NewBatchServerCodec(conn))
+}
@@ -0,0 +1,313 @@
+package bencoderpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// ctxCodec is implemented by a ServerCodec that can recover the
+// context.Context associated with a pending request sequence. *serverCodec
+// and *batchServerCodec both implement it, via serverCodec.Context.
+type ctxCodec interface {
+	Context(seq uint64) context.Context
+}
+
+// cancelAllCodec is implemented by a ServerCodec that can cancel every
+// context.Context it has handed out for a request still in flight.
+// *serverCodec and *batchServerCodec both implement it, via
+// serverCodec.cancelPending. ServeCodec calls it as soon as the
+// connection goes away, rather than waiting until the in-flight handlers
+// have all returned, since a context-aware handler blocked on
+// <-ctx.Done() is one of the things it may be waiting to unblock.
+type cancelAllCodec interface {
+	cancelPending()
+}
+
+// Server's registration (register/suitableMethods/isExported*) and
+// dispatch loop (ServeConn/ServeCodec/readRequest/readRequestHeader/
+// sendResponse/call) are a fork of Go 1.21's net/rpc/server.go, adapted
+// to dispatch the extra context.Context argument a method may take; stock
+// rpc.Server has no hook for injecting one. Keep this in sync with
+// upstream net/rpc fixes by hand; there's no way to delegate to it here.
+//
+// Server is an analogue of rpc.Server whose registered methods may
+// optionally take a context.Context as their first argument:
+//
+//	func (t *T) Method(ctx context.Context, args *Args, reply *Reply) error
+//
+// in addition to the ordinary net/rpc shape. A context-aware method's
+// Context is cancelled when the client sends a matching "c" cancellation
+// message (see Client.CallContext), or when the connection closes.
+//
+// Server exists because rpc.Server's reflection only ever calls the
+// ordinary two-argument shape; code that doesn't need cancellation can
+// keep using rpc.Register and the package-level ServeConn.
+type Server struct {
+	mu       sync.Mutex
+	services map[string]*service
+}
+
+type service struct {
+	name    string
+	rcvr    reflect.Value
+	typ     reflect.Type
+	methods map[string]*svcMethod
+}
+
+type svcMethod struct {
+	fn        reflect.Method
+	argType   reflect.Type
+	replyType reflect.Type
+	takesCtx  bool
+}
+
+// NewServer returns a new Server with no services registered.
+func NewServer() *Server {
+	return &Server{services: make(map[string]*service)}
+}
+
+// Register publishes the receiver's suitable methods under its own type
+// name. It is an error if rcvr's type is not exported, has no suitable
+// methods, or a service of that name is already registered.
+func (server *Server) Register(rcvr interface{}) error {
+	return server.register(rcvr, "", false)
+}
+
+// RegisterName is like Register but uses the provided name for the
+// service instead of the receiver's type name.
+func (server *Server) RegisterName(name string, rcvr interface{}) error {
+	return server.register(rcvr, name, true)
+}
+
+func (server *Server) register(rcvr interface{}, name string, useName bool) error {
+	s := &service{
+		rcvr: reflect.ValueOf(rcvr),
+		typ:  reflect.TypeOf(rcvr),
+	}
+	sname := name
+	if !useName {
+		sname = reflect.Indirect(s.rcvr).Type().Name()
+	}
+	if sname == "" {
+		return errors.New("bencoderpc: no service name for type " + s.typ.String())
+	}
+	if !useName && !isExported(sname) {
+		return errors.New("bencoderpc: type " + sname + " is not exported")
+	}
+	s.name = sname
+	s.methods = suitableMethods(s.typ)
+	if len(s.methods) == 0 {
+		return errors.New("bencoderpc: type " + sname + " has no exported methods of suitable type")
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, dup := server.services[sname]; dup {
+		return errors.New("bencoderpc: service already defined: " + sname)
+	}
+	server.services[sname] = s
+	return nil
+}
+
+func isExported(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r)
+}
+
+func isExportedOrBuiltin(t reflect.Type) bool {
+	if isExported(t.Name()) {
+		return true
+	}
+	return t.PkgPath() == ""
+}
+
+// suitableMethods returns typ's exported methods matching either
+// func(argType, replyType) error or func(context.Context, argType, replyType) error,
+// where replyType is a pointer.
+func suitableMethods(typ reflect.Type) map[string]*svcMethod {
+	methods := make(map[string]*svcMethod)
+	for m := 0; m < typ.NumMethod(); m++ {
+		rm := typ.Method(m)
+		mtype := rm.Type
+		if rm.PkgPath != "" {
+			continue
+		}
+
+		takesCtx := mtype.NumIn() == 4 && mtype.In(1) == typeOfContext
+		if !takesCtx && mtype.NumIn() != 3 {
+			continue
+		}
+		argIdx := 1
+		if takesCtx {
+			argIdx = 2
+		}
+
+		argType := mtype.In(argIdx)
+		if !isExportedOrBuiltin(argType) {
+			continue
+		}
+		replyType := mtype.In(argIdx + 1)
+		if replyType.Kind() != reflect.Ptr || !isExportedOrBuiltin(replyType) {
+			continue
+		}
+		if mtype.NumOut() != 1 || mtype.Out(0) != typeOfError {
+			continue
+		}
+		methods[rm.Name] = &svcMethod{fn: rm, argType: argType, replyType: replyType, takesCtx: takesCtx}
+	}
+	return methods
+}
+
+// ServeConn runs the server on a single connection, dispatching both
+// ordinary and context-aware methods. ServeConn blocks; the caller
+// typically invokes it in a go statement.
+func (server *Server) ServeConn(conn io.ReadWriteCloser) {
+	server.ServeCodec(NewServerCodec(conn))
+}
+
+// ServeBatchConn is like ServeConn, but additionally accepts a bencode
+// list of requests as a single batch, as ServeBatchConn does.
+func (server *Server) ServeBatchConn(conn io.ReadWriteCloser) {
+	server.ServeCodec(NewBatchServerCodec(conn))
+}
+
+// ServeCodec runs the server on a single connection already wrapped in a
+// ServerCodec. ServeCodec blocks until codec.ReadRequestHeader returns an
+// error, then closes codec.
+func (server *Server) ServeCodec(codec rpc.ServerCodec) {
+	var sending sync.Mutex
+	var wg sync.WaitGroup
+	for {
+		svc, mtype, req, argv, replyv, keepReading, err := server.readRequest(codec)
+		if err != nil {
+			if !keepReading {
+				break
+			}
+			if req.ServiceMethod != "" {
+				server.sendResponse(&sending, req, invalidRequest, codec, err.Error())
+			}
+			continue
+		}
+		wg.Add(1)
+		go server.call(&wg, &sending, svc, mtype, req, argv, replyv, codec)
+	}
+	// The connection is gone, so no further cancel message or response
+	// will ever reach a still-running handler; cancel whatever contexts
+	// codec has handed out before waiting for them, or a handler blocked
+	// on its own <-ctx.Done() would leak forever and wg.Wait would never
+	// return.
+	if cc, ok := codec.(cancelAllCodec); ok {
+		cc.cancelPending()
+	}
+	wg.Wait()
+	codec.Close()
+}
+
+var invalidRequest = struct{}{}
+
+func (server *Server) readRequest(codec rpc.ServerCodec) (svc *service, mtype *svcMethod, req rpc.Request, argv, replyv reflect.Value, keepReading bool, err error) {
+	svc, mtype, req, keepReading, err = server.readRequestHeader(codec)
+	if err != nil {
+		if !keepReading {
+			return
+		}
+		codec.ReadRequestBody(nil)
+		return
+	}
+
+	argIsValue := false
+	if mtype.argType.Kind() == reflect.Ptr {
+		argv = reflect.New(mtype.argType.Elem())
+	} else {
+		argv = reflect.New(mtype.argType)
+		argIsValue = true
+	}
+	if err = codec.ReadRequestBody(argv.Interface()); err != nil {
+		return
+	}
+	if argIsValue {
+		argv = argv.Elem()
+	}
+
+	replyv = reflect.New(mtype.replyType.Elem())
+	return
+}
+
+func (server *Server) readRequestHeader(codec rpc.ServerCodec) (svc *service, mtype *svcMethod, req rpc.Request, keepReading bool, err error) {
+	err = codec.ReadRequestHeader(&req)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		}
+		err = errors.New("bencoderpc: server cannot decode request: " + err.Error())
+		return
+	}
+	keepReading = true
+
+	dot := strings.LastIndex(req.ServiceMethod, ".")
+	if dot < 0 {
+		err = errors.New("bencoderpc: service/method request ill-formed: " + req.ServiceMethod)
+		return
+	}
+	serviceName := req.ServiceMethod[:dot]
+	methodName := req.ServiceMethod[dot+1:]
+
+	server.mu.Lock()
+	svc = server.services[serviceName]
+	server.mu.Unlock()
+	if svc == nil {
+		err = errors.New("bencoderpc: can't find service " + req.ServiceMethod)
+		return
+	}
+	mtype = svc.methods[methodName]
+	if mtype == nil {
+		err = errors.New("bencoderpc: can't find method " + req.ServiceMethod)
+	}
+	return
+}
+
+func (server *Server) sendResponse(sending *sync.Mutex, req rpc.Request, reply interface{}, codec rpc.ServerCodec, errmsg string) {
+	resp := rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq, Error: errmsg}
+	sending.Lock()
+	codec.WriteResponse(&resp, reply)
+	sending.Unlock()
+}
+
+func (server *Server) call(wg *sync.WaitGroup, sending *sync.Mutex, svc *service, mtype *svcMethod, req rpc.Request, argv, replyv reflect.Value, codec rpc.ServerCodec) {
+	defer wg.Done()
+
+	in := make([]reflect.Value, 0, 4)
+	in = append(in, svc.rcvr)
+	if mtype.takesCtx {
+		ctx := context.Background()
+		if cc, ok := codec.(ctxCodec); ok {
+			ctx = cc.Context(req.Seq)
+		}
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, argv, replyv)
+
+	returnValues := mtype.fn.Func.Call(in)
+	errmsg := ""
+	if errInter := returnValues[0].Interface(); errInter != nil {
+		errmsg = errInter.(error).Error()
+	}
+	// Sending replyv here, rather than invalidRequest, matches net/rpc's
+	// own service.call: invalidRequest is only ever sent for a request
+	// that never reached a method call at all (bad service/method name,
+	// unreadable args); once the method runs, its reply value goes back
+	// even when it also returned an error.
+	server.sendResponse(sending, req, replyv.Interface(), codec, errmsg)
+}